@@ -0,0 +1,195 @@
+package bptree
+
+import (
+	"bytes"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// fillFactor is the fraction of a leaf's capacity the Builder packs
+// before starting a new one. Leaving some headroom keeps a
+// freshly-built tree from immediately splitting on the first Add.
+const fillFactor = 0.95
+
+// Builder bulk-loads a BpTree from a large key/value stream without
+// paying for a root-to-leaf walk and possible split on every entry.
+// It is the on-disk analogue of the bucketed bulk-build used by
+// arbo: sort once, pack leaves to a fill factor, and build the
+// internal levels bottom-up from the leaves' first keys.
+type Builder struct {
+	tree *BpTree
+	keys [][]byte
+	vals [][]byte
+}
+
+// NewBuilder creates a Builder that will load into self. The tree
+// should be empty; Builder replaces self.meta.root wholesale when
+// Build is called.
+func (self *BpTree) NewBuilder() *Builder {
+	return &Builder{tree: self}
+}
+
+// Add stages a key/value pair for the next Build call. Unlike
+// BpTree.Add this does no I/O; the pair is only sorted and written
+// out when Build runs.
+func (self *Builder) Add(key, value []byte) error {
+	if len(key) != int(self.tree.meta.keySize) {
+		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.tree.meta.keySize)
+	}
+	self.keys = append(self.keys, key)
+	self.vals = append(self.vals, value)
+	return nil
+}
+
+// AddBatch is a convenience wrapper for loading a whole presorted (or
+// not yet sorted -- Build will sort it) slice of keys and values at
+// once.
+func (self *BpTree) AddBatch(keys, values [][]byte) error {
+	b := self.NewBuilder()
+	for i := range keys {
+		if err := b.Add(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return b.Build()
+}
+
+// Build sorts the staged entries (stable, so duplicate keys keep
+// their Add order the way repeated BpTree.Add calls would), packs
+// them into leaves bottom-up, links the leaves via insertListNode,
+// builds each internal level above them from the children's
+// firstKey, and finally writes a fresh meta pointing at the new
+// root, freeing the tree's prior root -- Build is meant to be used
+// once against a freshly created tree, so the old root is just the
+// single empty leaf New/NewWithStore allocated.
+func (self *Builder) Build() (err error) {
+	sort.Stable(self)
+	leaves, err := self.buildLeaves()
+	if err != nil {
+		return err
+	}
+	if len(leaves) == 0 {
+		return nil
+	}
+	level := leaves
+	for len(level) > 1 {
+		level, err = self.buildLevel(level)
+		if err != nil {
+			return err
+		}
+	}
+	oldRoot := self.tree.meta.root
+	self.tree.meta.root = level[0]
+	if oldRoot != 0 && oldRoot != self.tree.meta.root {
+		if err := self.tree.store.Free(oldRoot); err != nil {
+			return err
+		}
+	}
+	return self.tree.writeMeta()
+}
+
+func (self *Builder) Len() int { return len(self.keys) }
+func (self *Builder) Less(i, j int) bool {
+	return bytes.Compare(self.keys[i], self.keys[j]) < 0
+}
+func (self *Builder) Swap(i, j int) {
+	self.keys[i], self.keys[j] = self.keys[j], self.keys[i]
+	self.vals[i], self.vals[j] = self.vals[j], self.vals[i]
+}
+
+// buildLeaves packs the sorted entries into as few leaves as the
+// fill factor allows and links them into the doubly linked leaf
+// list.
+func (self *Builder) buildLeaves() (leaves []uint64, err error) {
+	tree := self.tree
+	i := 0
+	var prev uint64 = 0
+	for i < len(self.keys) {
+		off, err := tree.newLeaf()
+		if err != nil {
+			return nil, err
+		}
+		err = tree.doLeaf(off, func(n *leaf) error {
+			threshold := int(float64(len(n.keys)) * fillFactor)
+			for i < len(self.keys) && int(n.meta.keyCount) < threshold {
+				valFlags := sMALL_VALUE
+				value := self.vals[i]
+				if len(value) > int(tree.store.BlockSize())/4 {
+					value, err = tree.makeBigValue(value)
+					if err != nil {
+						return err
+					}
+					valFlags = bIG_VALUE
+				}
+				if !n.fits(value) {
+					break
+				}
+				if err := n.putKV(valFlags, self.keys[i], value); err != nil {
+					return err
+				}
+				i++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if prev != 0 {
+			if err := tree.insertListNode(off, prev, 0); err != nil {
+				return nil, err
+			}
+		}
+		leaves = append(leaves, off)
+		prev = off
+	}
+	return leaves, nil
+}
+
+// buildLevel builds one layer of internal nodes above children,
+// packing one KP per child (using firstKey) and starting a fresh
+// internal node whenever the current one is full.
+func (self *Builder) buildLevel(children []uint64) (level []uint64, err error) {
+	tree := self.tree
+	var cur uint64
+	for i, c := range children {
+		if i == 0 || cur == 0 {
+			cur, err = tree.newInternal()
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, cur)
+		}
+		var full bool
+		err = tree.firstKey(c, func(key []byte) error {
+			return tree.doInternal(cur, func(n *internal) error {
+				if n.full() {
+					full = true
+					return nil
+				}
+				return n.putKP(key, c)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if full {
+			cur, err = tree.newInternal()
+			if err != nil {
+				return nil, err
+			}
+			level = append(level, cur)
+			err = tree.firstKey(c, func(key []byte) error {
+				return tree.doInternal(cur, func(n *internal) error {
+					return n.putKP(key, c)
+				})
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return level, nil
+}
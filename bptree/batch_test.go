@@ -0,0 +1,87 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestAddBatchBuildsOrderedTree(t *testing.T) {
+	tree := newTestTree(t, 5)
+	const n = 200
+	keys := make([][]byte, n)
+	values := make([][]byte, n)
+	// feed the batch in reverse to make sure Build actually sorts
+	// rather than relying on already-sorted input.
+	for i := 0; i < n; i++ {
+		k := n - 1 - i
+		keys[i] = []byte(fmt.Sprintf("k%04d", k))
+		values[i] = []byte(fmt.Sprintf("v%04d", k))
+	}
+	if err := tree.AddBatch(keys, values); err != nil {
+		t.Fatalf("AddBatch: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		want := []byte(fmt.Sprintf("v%04d", i))
+		got, has, err := tree.getFirst(key)
+		if err != nil {
+			t.Fatalf("getFirst(%s): %v", key, err)
+		}
+		if !has {
+			t.Fatalf("expected %s to be present after AddBatch", key)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+// TestBuildFreesOldRoot guards against a leak: Build is meant to run
+// once against a freshly created tree, and the empty leaf that
+// New/NewWithStore allocated as the initial root is never reachable
+// again once Build picks its own root, so Build must free it.
+func TestBuildFreesOldRoot(t *testing.T) {
+	store := NewMemStore(4096)
+	tree, err := NewWithStore(store, 4)
+	if err != nil {
+		t.Fatalf("NewWithStore: %v", err)
+	}
+	oldRoot := tree.meta.root
+	b := tree.NewBuilder()
+	if err := b.Add([]byte("aaaa"), []byte("1")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := b.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if tree.meta.root == oldRoot {
+		t.Fatalf("test setup did not actually replace the root")
+	}
+	if _, present := store.blocks[oldRoot]; present {
+		t.Fatalf("old root block %d was not freed by Build", oldRoot)
+	}
+}
+
+func TestBuilderAddBuild(t *testing.T) {
+	tree := newTestTree(t, 4)
+	b := tree.NewBuilder()
+	if err := b.Add([]byte("bbbb"), []byte("2")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := b.Add([]byte("aaaa"), []byte("1")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := b.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	for key, want := range map[string]string{"aaaa": "1", "bbbb": "2"} {
+		got, has, err := tree.getFirst([]byte(key))
+		if err != nil || !has {
+			t.Fatalf("getFirst(%s): has=%v err=%v", key, has, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 import (
 	"github.com/timtadh/fs2/errors"
-	"github.com/timtadh/fs2/fmap"
 )
 
 // Add a key/value pair to the tree. There is a reason this isn't called
@@ -52,7 +51,7 @@ func (self *BpTree) Add(key, value []byte) error {
  */
 func (self *BpTree) insert(n uint64, key, value []byte) (a, b uint64, err error) {
 	var flags flag
-	err = self.bf.Do(n, 1, func(bytes []byte) error {
+	err = self.store.Do(n, 1, func(bytes []byte) error {
 		flags = flag(bytes[0])
 		return nil
 	})
@@ -126,7 +125,7 @@ func (self *BpTree) internalInsert(n uint64, key, value []byte) (a, b uint64, er
 }
 
 func (self *BpTree) leafInsert(n uint64, key, value []byte) (a, b uint64, err error) {
-	if len(value) > int(self.bf.BlockSize())/4 {
+	if len(value) > int(self.store.BlockSize())/4 {
 		return self.leafBigInsert(n, key, value)
 	}
 	return self.leafDoInsert(n, sMALL_VALUE, key, value)
@@ -159,12 +158,12 @@ func (self *BpTree) leafDoInsert(n uint64, valFlags flag, key, value []byte) (a,
 }
 
 func (self *BpTree) makeBigValue(value []byte) (bigVal []byte, err error) {
-	N := blksNeeded(self.bf, len(value))
-	a, err := self.bf.AllocateBlocks(N)
+	N := blksNeeded(self.store.BlockSize(), len(value))
+	a, err := self.store.Alloc(N)
 	if err != nil {
 		return nil, err
 	}
-	err = self.bf.Do(a, uint64(N), func(bytes []byte) error {
+	err = self.store.Do(a, uint64(N), func(bytes []byte) error {
 		if len(bytes) < len(value) {
 			return errors.Errorf("Did not have enough bytes")
 		}
@@ -182,8 +181,8 @@ func (self *BpTree) makeBigValue(value []byte) (bigVal []byte, err error) {
 	return bv_bytes, nil
 }
 
-func blksNeeded(bf *fmap.BlockFile, size int) int {
-	blk := int(bf.BlockSize())
+func blksNeeded(blockSize uint64, size int) int {
+	blk := int(blockSize)
 	m := size % blk
 	if m == 0 {
 		return size / blk
@@ -335,7 +334,7 @@ func (self *BpTree) pureLeafSplit(n uint64, valFlags flag, key, value []byte) (a
 		return 0, 0, err
 	}
 	if unneeded {
-		err = self.bf.Free(new_off)
+		err = self.store.Free(new_off)
 		if err != nil {
 			return 0, 0, err
 		}
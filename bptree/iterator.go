@@ -0,0 +1,286 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+// KVIterator walks a run of key/value pairs via the leaf linked
+// list that leafSplit/pureLeafSplit already maintain. It is the
+// natural read-side counterpart to the insertion machinery: Range,
+// PrefixRange, and ReverseRange below all return one of these rather
+// than eagerly materializing their results.
+type KVIterator struct {
+	tree    *BpTree
+	leaf    uint64
+	i       int
+	reverse bool
+	done    bool
+	curKey  []byte
+	curVal  []byte
+	// valid reports whether the current (key, value) pair is still
+	// within the requested range; once it turns false the iterator
+	// is exhausted.
+	valid func(key []byte) bool
+}
+
+// Range returns a KVIterator over every key k with from <= k < to (in
+// key order; from == nil means "no lower bound" and to == nil means
+// "no upper bound"). It descends to the starting leaf with the same
+// find logic internalInsert/internalPut use and then walks
+// meta.next.
+func (self *BpTree) Range(from, to []byte) (*KVIterator, error) {
+	start := from
+	if start == nil {
+		start = make([]byte, self.meta.keySize)
+	}
+	n, err := self.find(self.meta.root, start)
+	if err != nil {
+		return nil, err
+	}
+	valid := func(key []byte) bool {
+		if to != nil && bytes.Compare(key, to) >= 0 {
+			return false
+		}
+		return true
+	}
+	return self.newIterator(n, start, from == nil, valid, false, false)
+}
+
+// PrefixRange returns a KVIterator over every key that begins with
+// prefix.
+func (self *BpTree) PrefixRange(prefix []byte) (*KVIterator, error) {
+	n, err := self.find(self.meta.root, prefix)
+	if err != nil {
+		return nil, err
+	}
+	valid := func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	}
+	return self.newIterator(n, prefix, false, valid, false, false)
+}
+
+// ReverseRange is the descending counterpart to Range: it returns
+// the same logical key range -- from <= k < to, from == nil meaning
+// "no lower bound" and to == nil meaning "no upper bound" -- but
+// walks it from the largest key down to the smallest via meta.prev.
+// Because to is exclusive, when it names an existing key newIterator
+// is told to start just below it rather than on it.
+func (self *BpTree) ReverseRange(from, to []byte) (*KVIterator, error) {
+	end := to
+	if end == nil {
+		end = bytes.Repeat([]byte{0xff}, int(self.meta.keySize))
+	}
+	n, err := self.find(self.meta.root, end)
+	if err != nil {
+		return nil, err
+	}
+	valid := func(key []byte) bool {
+		if from != nil && bytes.Compare(key, from) < 0 {
+			return false
+		}
+		if to != nil && bytes.Compare(key, to) >= 0 {
+			return false
+		}
+		return true
+	}
+	return self.newIterator(n, end, false, valid, true, to != nil)
+}
+
+// newIterator positions a fresh iterator at the first entry of leaf
+// n whose key is >= seek (for a reverse iterator, the last entry
+// <= seek; or the first entry, period, when fromStart is true),
+// ready to be walked with Next. excludeExact
+// additionally steps a reverse iterator past seek when seek itself
+// is an exact match, for callers (ReverseRange's exclusive upper
+// bound) that want strictly-less-than rather than less-than-or-equal
+// semantics.
+func (self *BpTree) newIterator(n uint64, seek []byte, fromStart bool, valid func([]byte) bool, reverse, excludeExact bool) (*KVIterator, error) {
+	kvi := &KVIterator{tree: self, leaf: n, reverse: reverse, valid: valid}
+	if fromStart {
+		kvi.i = -1
+		return kvi, nil
+	}
+	has, err := kvi.seekIn(seek)
+	if err != nil {
+		return nil, err
+	}
+	if excludeExact && has && reverse {
+		kvi.i--
+	}
+	kvi.rewindOne()
+	return kvi, nil
+}
+
+// Seek repositions the iterator at the first entry >= key (or, for a
+// reverse iterator, the last entry <= key), so a range scan can be
+// paused and resumed without starting over from the beginning. When
+// key itself occurs more than once, both directions start at the
+// first of its duplicates, so a reverse iterator does not visit the
+// later ones.
+func (self *KVIterator) Seek(key []byte) error {
+	n, err := self.tree.find(self.tree.meta.root, key)
+	if err != nil {
+		return err
+	}
+	self.leaf = n
+	self.done = false
+	if _, err := self.seekIn(key); err != nil {
+		return err
+	}
+	self.rewindOne()
+	return nil
+}
+
+// rewindOne steps i back one position from where seekIn left it, so
+// that Next's own advance (i++ forward, i-- reverse) lands exactly on
+// the entry seekIn found. "Back" means the opposite of Next's
+// direction: -1 for a forward iterator, +1 for a reverse one.
+func (self *KVIterator) rewindOne() {
+	if self.reverse {
+		self.i++
+	} else {
+		self.i--
+	}
+}
+
+// seekIn positions the iterator within the current leaf at the first
+// entry >= key (or, for a reverse iterator, the last entry <= key),
+// and reports whether key itself was found so callers like
+// newIterator's excludeExact handling can tell an exact match from a
+// nearby one.
+func (self *KVIterator) seekIn(key []byte) (has bool, err error) {
+	err = self.tree.doLeaf(self.leaf, func(n *leaf) error {
+		i, h := find(int(n.meta.keyCount), n.keys, key)
+		if !h && self.reverse {
+			// may become -1 when every key in the leaf is > key;
+			// Next then moves on to the previous leaf.
+			i--
+		}
+		has = h
+		self.i = i
+		return nil
+	})
+	return has, err
+}
+
+// Next advances the iterator and reports whether a key/value pair is
+// available. It must be called before the first Key/Value.
+func (self *KVIterator) Next() bool {
+	if self.done {
+		return false
+	}
+	for {
+		if self.reverse {
+			self.i--
+		} else {
+			self.i++
+		}
+		var count int
+		var atEnd bool
+		var key, value []byte
+		var flags flag
+		err := self.tree.doLeaf(self.leaf, func(n *leaf) error {
+			count = int(n.meta.keyCount)
+			if self.i >= 0 && self.i < count {
+				key = n.keys[self.i]
+				value = n.vals[self.i]
+				flags = n.flags[self.i]
+			}
+			if self.reverse {
+				atEnd = self.i < 0
+			} else {
+				atEnd = self.i >= count
+			}
+			return nil
+		})
+		if err != nil {
+			self.done = true
+			return false
+		}
+		if atEnd {
+			next, err := self.advanceLeaf()
+			if err != nil || !next {
+				self.done = true
+				return false
+			}
+			continue
+		}
+		if !self.valid(key) {
+			self.done = true
+			return false
+		}
+		if flags&bIG_VALUE != 0 {
+			bv, err := parseBigValue(value)
+			if err != nil {
+				self.done = true
+				return false
+			}
+			value, _, err = self.tree.readBigValue(bv)
+			if err != nil {
+				self.done = true
+				return false
+			}
+		}
+		self.curKey = key
+		self.curVal = value
+		return true
+	}
+}
+
+// advanceLeaf moves the iterator to the neighboring leaf (meta.next
+// when walking forward, meta.prev in reverse), returning false when
+// there is none.
+func (self *KVIterator) advanceLeaf() (bool, error) {
+	var neighbor uint64
+	err := self.tree.doLeaf(self.leaf, func(n *leaf) error {
+		if self.reverse {
+			neighbor = n.meta.prev
+		} else {
+			neighbor = n.meta.next
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if neighbor == 0 {
+		return false, nil
+	}
+	self.leaf = neighbor
+	if self.reverse {
+		var count int
+		err := self.tree.doLeaf(neighbor, func(n *leaf) error {
+			count = int(n.meta.keyCount)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		self.i = count
+	} else {
+		self.i = -1
+	}
+	return true, nil
+}
+
+// Key returns the key of the current entry. Only valid after a call
+// to Next that returned true.
+func (self *KVIterator) Key() []byte {
+	return self.curKey
+}
+
+// Value returns the value of the current entry, decoded through a
+// big-value block if necessary. Only valid after a call to Next that
+// returned true.
+func (self *KVIterator) Value() []byte {
+	return self.curVal
+}
+
+// Close ends the iterator: later calls to Next return false. The
+// iterator only holds block offsets, so there is nothing else to
+// release, but Close is provided so callers can defer it the way
+// they would for any other streaming resource.
+func (self *KVIterator) Close() error {
+	self.done = true
+	return nil
+}
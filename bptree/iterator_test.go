@@ -0,0 +1,138 @@
+package bptree
+
+import (
+	"testing"
+)
+
+func collect(t *testing.T, kvi *KVIterator) (keys []string) {
+	t.Helper()
+	for kvi.Next() {
+		keys = append(keys, string(kvi.Key()))
+	}
+	return keys
+}
+
+func populatedTree(t *testing.T) *BpTree {
+	t.Helper()
+	tree := newTestTree(t, 4)
+	for _, k := range []string{"0010", "0020", "0030", "0040"} {
+		if err := tree.Add([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatalf("Add(%s): %v", k, err)
+		}
+	}
+	return tree
+}
+
+func TestRangeForward(t *testing.T) {
+	tree := populatedTree(t)
+	kvi, err := tree.Range([]byte("0020"), []byte("0040"))
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	got := collect(t, kvi)
+	want := []string{"0020", "0030"}
+	if !stringsEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestRangeUnbounded(t *testing.T) {
+	tree := populatedTree(t)
+	kvi, err := tree.Range(nil, nil)
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	got := collect(t, kvi)
+	want := []string{"0010", "0020", "0030", "0040"}
+	if !stringsEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tree := newTestTree(t, 4)
+	for _, k := range []string{"a001", "a002", "b001"} {
+		if err := tree.Add([]byte(k), []byte("v")); err != nil {
+			t.Fatalf("Add(%s): %v", k, err)
+		}
+	}
+	kvi, err := tree.PrefixRange([]byte("a"))
+	if err != nil {
+		t.Fatalf("PrefixRange: %v", err)
+	}
+	got := collect(t, kvi)
+	want := []string{"a001", "a002"}
+	if !stringsEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestReverseRangeOrder(t *testing.T) {
+	tree := populatedTree(t)
+	kvi, err := tree.ReverseRange(nil, nil)
+	if err != nil {
+		t.Fatalf("ReverseRange: %v", err)
+	}
+	got := collect(t, kvi)
+	want := []string{"0040", "0030", "0020", "0010"}
+	if !stringsEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestReverseRangeExcludesUpperBound guards the bug where
+// ReverseRange's valid closure never checked to, so an existing upper
+// bound either leaked into the results or (once seekIn lands exactly
+// on it) terminated the whole scan instead of simply excluding it.
+func TestReverseRangeExcludesUpperBound(t *testing.T) {
+	tree := populatedTree(t)
+	kvi, err := tree.ReverseRange([]byte("0020"), []byte("0040"))
+	if err != nil {
+		t.Fatalf("ReverseRange: %v", err)
+	}
+	got := collect(t, kvi)
+	want := []string{"0030", "0020"}
+	if !stringsEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestReverseSeekLandsOnSeekedKey guards the bug where a reverse
+// iterator's first Next() after Seek skipped the seeked-to entry (or
+// terminated immediately) instead of yielding it first.
+func TestReverseSeekLandsOnSeekedKey(t *testing.T) {
+	tree := populatedTree(t)
+	kvi, err := tree.ReverseRange(nil, nil)
+	if err != nil {
+		t.Fatalf("ReverseRange: %v", err)
+	}
+	if err := kvi.Seek([]byte("0025")); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if !kvi.Next() {
+		t.Fatalf("expected at least one result after seeking to 0025")
+	}
+	if got := string(kvi.Key()); got != "0020" {
+		t.Fatalf("first key after Seek(0025) on a reverse iterator: got %q, want %q", got, "0020")
+	}
+	rest := []string{"0020"}
+	for kvi.Next() {
+		rest = append(rest, string(kvi.Key()))
+	}
+	want := []string{"0020", "0010"}
+	if !stringsEqual(rest, want) {
+		t.Fatalf("got %v, want %v", rest, want)
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,294 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Put a key/value pair into the tree. Unlike Add, Put will locate an
+// existing entry for key (the first one, if the tree has duplicates)
+// and overwrite its value in place rather than appending a new entry.
+// If no entry for key exists, Put behaves exactly like Add. The
+// returned replaced flag tells you which case happened.
+func (self *BpTree) Put(key, value []byte) (replaced bool, err error) {
+	if len(key) != int(self.meta.keySize) {
+		return false, errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
+	}
+	a, b, found, err := self.put(self.meta.root, key, value)
+	if err != nil {
+		return false, err
+	} else if b == 0 {
+		self.meta.root = a
+		return found, self.writeMeta()
+	}
+	root, err := self.newInternal()
+	if err != nil {
+		return false, err
+	}
+	err = self.doInternal(root, func(n *internal) error {
+		err := self.firstKey(a, func(akey []byte) error {
+			return n.putKP(akey, a)
+		})
+		if err != nil {
+			return err
+		}
+		return self.firstKey(b, func(bkey []byte) error {
+			return n.putKP(bkey, b)
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	self.meta.root = root
+	return found, self.writeMeta()
+}
+
+// Upsert locates the (unique, or first) entry for key and calls fn
+// with its current value (and exists == false if there was none). If
+// fn returns keep == false the entry is left untouched (or simply not
+// created). Otherwise newVal is written in place of the old value,
+// allocating a new leaf slot if the tree had to split to make room.
+func (self *BpTree) Upsert(key []byte, fn func(old []byte, exists bool) (newVal []byte, keep bool)) error {
+	if len(key) != int(self.meta.keySize) {
+		return errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
+	}
+	old, has, err := self.getFirst(key)
+	if err != nil {
+		return err
+	}
+	newVal, keep := fn(old, has)
+	if !keep {
+		return nil
+	}
+	_, err = self.Put(key, newVal)
+	return err
+}
+
+// getFirst returns the value of the first entry matching key, if any,
+// decoding it through a big-value block when needed.
+func (self *BpTree) getFirst(key []byte) (value []byte, has bool, err error) {
+	n, err := self.find(self.meta.root, key)
+	if err != nil {
+		return nil, false, err
+	}
+	var flags flag
+	err = self.doLeaf(n, func(n *leaf) error {
+		var i int
+		i, has = find(int(n.meta.keyCount), n.keys, key)
+		if !has {
+			return nil
+		}
+		flags = n.flags[i]
+		value = make([]byte, len(n.vals[i]))
+		copy(value, n.vals[i])
+		return nil
+	})
+	if err != nil || !has {
+		return nil, false, err
+	}
+	if flags&bIG_VALUE != 0 {
+		bv, err := parseBigValue(value)
+		if err != nil {
+			return nil, false, err
+		}
+		return self.readBigValue(bv)
+	}
+	return value, true, nil
+}
+
+// find descends from n to the leaf that would contain key, using the
+// same child-selection logic as internalInsert/internalPut.
+func (self *BpTree) find(n uint64, key []byte) (leafOff uint64, err error) {
+	var flags flag
+	err = self.store.Do(n, 1, func(bytes []byte) error {
+		flags = flag(bytes[0])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if flags&lEAF != 0 {
+		return n, nil
+	}
+	var ptr uint64
+	err = self.doInternal(n, func(n *internal) error {
+		i, has := find(int(n.meta.keyCount), n.keys, key)
+		if !has && i > 0 {
+			i--
+		}
+		ptr = n.ptrs[i]
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return self.find(ptr, key)
+}
+
+/* put mirrors insert: it walks to the right leaf and either rewrites
+ * the existing entry there or falls through to the normal insert path
+ * when the key is not present.
+ */
+func (self *BpTree) put(n uint64, key, value []byte) (a, b uint64, found bool, err error) {
+	var flags flag
+	err = self.store.Do(n, 1, func(bytes []byte) error {
+		flags = flag(bytes[0])
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if flags&iNTERNAL != 0 {
+		return self.internalPut(n, key, value)
+	} else if flags&lEAF != 0 {
+		return self.leafPut(n, key, value)
+	} else {
+		return 0, 0, false, errors.Errorf("Unknown block type")
+	}
+}
+
+func (self *BpTree) internalPut(n uint64, key, value []byte) (a, b uint64, found bool, err error) {
+	var i int
+	var ptr uint64
+	err = self.doInternal(n, func(n *internal) error {
+		var has bool
+		i, has = find(int(n.meta.keyCount), n.keys, key)
+		if !has && i > 0 {
+			i--
+		}
+		ptr = n.ptrs[i]
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	p, q, found, err := self.put(ptr, key, value)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var must_split bool = false
+	var split_key []byte = nil
+	err = self.doInternal(n, func(m *internal) error {
+		m.ptrs[i] = p
+		err := self.firstKey(p, func(key []byte) error {
+			copy(m.keys[i], key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if q != 0 {
+			return self.firstKey(q, func(key []byte) error {
+				if m.full() {
+					must_split = true
+					split_key = make([]byte, len(key))
+					copy(split_key, key)
+					return nil
+				}
+				return m.putKP(key, q)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if must_split {
+		a, b, err = self.internalSplit(n, split_key, q)
+		return a, b, found, err
+	}
+	return n, 0, found, nil
+}
+
+// leafPut looks for key in the leaf. If found, it rewrites the value
+// in place (promoting/demoting between sMALL_VALUE and bIG_VALUE as
+// needed; an old big-value run is always freed via store.Free, and a
+// new run is allocated if the new value is big). If not found it falls back to the
+// normal insert path so Put behaves like Add for new keys.
+func (self *BpTree) leafPut(n uint64, key, value []byte) (a, b uint64, found bool, err error) {
+	var i int
+	var has bool
+	var oldFlags flag
+	var oldValue []byte
+	err = self.doLeaf(n, func(n *leaf) error {
+		i, has = find(int(n.meta.keyCount), n.keys, key)
+		if has {
+			oldFlags = n.flags[i]
+			oldValue = n.vals[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if !has {
+		a, b, err = self.leafInsert(n, key, value)
+		return a, b, false, err
+	}
+	if oldFlags&bIG_VALUE != 0 {
+		if bv, perr := parseBigValue(oldValue); perr == nil {
+			if ferr := self.store.Free(bv.offset); ferr != nil {
+				return 0, 0, false, ferr
+			}
+		}
+	}
+	newFlags := sMALL_VALUE
+	newVal := value
+	if len(value) > int(self.store.BlockSize())/4 {
+		newVal, err = self.makeBigValue(value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		newFlags = bIG_VALUE
+	}
+	var mustSplit bool = false
+	err = self.doLeaf(n, func(n *leaf) error {
+		if len(newVal) <= len(oldValue) {
+			n.flags[i] = newFlags
+			copy(n.vals[i], newVal)
+			n.vals[i] = n.vals[i][:len(newVal)]
+			return nil
+		}
+		if err := n.delKV(i); err != nil {
+			return err
+		}
+		if !n.fits(newVal) {
+			mustSplit = true
+			return nil
+		}
+		return n.putKV(newFlags, key, newVal)
+	})
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if mustSplit {
+		a, b, err = self.leafSplit(n, newFlags, key, newVal)
+		return a, b, true, err
+	}
+	return n, 0, true, nil
+}
+
+// parseBigValue decodes the on-disk pointer/size record that
+// makeBigValue produces back into a *bigValue.
+func parseBigValue(encoded []byte) (bv *bigValue, err error) {
+	bv = &bigValue{}
+	err = bv.Parse(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return bv, nil
+}
+
+// readBigValue reads the run of blocks a bigValue points at back into
+// a single contiguous slice.
+func (self *BpTree) readBigValue(bv *bigValue) (value []byte, has bool, err error) {
+	N := blksNeeded(self.store.BlockSize(), int(bv.size))
+	value = make([]byte, bv.size)
+	err = self.store.Do(bv.offset, uint64(N), func(bytes []byte) error {
+		copy(value, bytes[:bv.size])
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
@@ -0,0 +1,120 @@
+package bptree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPutReplacesExistingValue(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("aaaa")
+	if err := tree.Add(key, []byte("old")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	replaced, err := tree.Put(key, []byte("new"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if !replaced {
+		t.Fatalf("expected Put to report a replacement")
+	}
+	value, has, err := tree.getFirst(key)
+	if err != nil || !has {
+		t.Fatalf("getFirst: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(value, []byte("new")) {
+		t.Fatalf("got %q, want %q", value, "new")
+	}
+}
+
+func TestPutAddsWhenMissing(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("bbbb")
+	replaced, err := tree.Put(key, []byte("v"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if replaced {
+		t.Fatalf("expected Put to report no replacement for a new key")
+	}
+	value, has, err := tree.getFirst(key)
+	if err != nil || !has {
+		t.Fatalf("getFirst: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(value, []byte("v")) {
+		t.Fatalf("got %q, want %q", value, "v")
+	}
+}
+
+func TestPutPromotesToBigValue(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("cccc")
+	if err := tree.Add(key, []byte("small")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	big := bytes.Repeat([]byte("x"), int(tree.store.BlockSize()))
+	if _, err := tree.Put(key, big); err != nil {
+		t.Fatalf("Put (big): %v", err)
+	}
+	value, has, err := tree.getFirst(key)
+	if err != nil || !has {
+		t.Fatalf("getFirst: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(value, big) {
+		t.Fatalf("big value round-trip mismatch, got %d bytes, want %d", len(value), len(big))
+	}
+	if replaced, err := tree.Put(key, []byte("small-again")); err != nil || !replaced {
+		t.Fatalf("Put (demote): replaced=%v err=%v", replaced, err)
+	}
+	value, has, err = tree.getFirst(key)
+	if err != nil || !has {
+		t.Fatalf("getFirst after demote: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(value, []byte("small-again")) {
+		t.Fatalf("got %q, want %q", value, "small-again")
+	}
+}
+
+func TestUpsertCreatesAndUpdates(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("dddd")
+	err := tree.Upsert(key, func(old []byte, exists bool) ([]byte, bool) {
+		if exists {
+			t.Fatalf("expected no existing value for a new key")
+		}
+		return []byte("1"), true
+	})
+	if err != nil {
+		t.Fatalf("Upsert (create): %v", err)
+	}
+	err = tree.Upsert(key, func(old []byte, exists bool) ([]byte, bool) {
+		if !exists || !bytes.Equal(old, []byte("1")) {
+			t.Fatalf("expected existing value %q, got exists=%v old=%q", "1", exists, old)
+		}
+		return []byte("2"), true
+	})
+	if err != nil {
+		t.Fatalf("Upsert (update): %v", err)
+	}
+	value, has, err := tree.getFirst(key)
+	if err != nil || !has {
+		t.Fatalf("getFirst: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(value, []byte("2")) {
+		t.Fatalf("got %q, want %q", value, "2")
+	}
+}
+
+func TestUpsertCanDeclineToKeep(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("eeee")
+	err := tree.Upsert(key, func(old []byte, exists bool) ([]byte, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+	if _, has, err := tree.getFirst(key); err != nil || has {
+		t.Fatalf("expected no entry to have been created, has=%v err=%v", has, err)
+	}
+}
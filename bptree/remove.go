@@ -0,0 +1,330 @@
+package bptree
+
+import (
+	"bytes"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Remove deletes every entry matching key from the tree (the tree
+// allows duplicate keys, and Remove does not distinguish between
+// them). It is an error to call Remove on a key that is not present.
+func (self *BpTree) Remove(key []byte) error {
+	n, err := self.RemoveWhere(key, func(value []byte) bool { return true })
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.Errorf("Key was not found, %v", key)
+	}
+	return nil
+}
+
+// RemoveWhere deletes every entry matching key for which where
+// returns true, and reports how many entries were removed. Passing a
+// where that always returns true removes every entry for key (useful
+// when the tree allows duplicates).
+func (self *BpTree) RemoveWhere(key []byte, where func(value []byte) bool) (removed int, err error) {
+	if len(key) != int(self.meta.keySize) {
+		return 0, errors.Errorf("Key was not the correct size got, %v, expected, %v", len(key), self.meta.keySize)
+	}
+	root, removed, err := self.remove(self.meta.root, key, where)
+	if err != nil {
+		return 0, err
+	}
+	root, err = self.emptyRoot(root)
+	if err != nil {
+		return 0, err
+	}
+	self.meta.root = root
+	return removed, self.writeMeta()
+}
+
+// emptyRoot replaces root with a fresh, empty leaf when the deletion
+// that just happened emptied it out, so the tree is always left with
+// a valid (if empty) leaf as its root.
+func (self *BpTree) emptyRoot(root uint64) (uint64, error) {
+	var isLeaf bool
+	var count int
+	err := self.store.Do(root, 1, func(b []byte) error {
+		isLeaf = flag(b[0])&lEAF != 0
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if isLeaf {
+		err = self.doLeaf(root, func(n *leaf) error {
+			count = int(n.meta.keyCount)
+			return nil
+		})
+	} else {
+		err = self.doInternal(root, func(n *internal) error {
+			count = int(n.meta.keyCount)
+			return nil
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return root, nil
+	}
+	if err := self.store.Free(root); err != nil {
+		return 0, err
+	}
+	return self.newLeaf()
+}
+
+/* remove mirrors insert: it descends to the leaf(s) holding key,
+ * deletes the matching entries there, and unwinds back up doing any
+ * rebalancing the deletion requires.
+ */
+func (self *BpTree) remove(n uint64, key []byte, where func(value []byte) bool) (newRoot uint64, removed int, err error) {
+	var flags flag
+	err = self.store.Do(n, 1, func(bytes []byte) error {
+		flags = flag(bytes[0])
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if flags&iNTERNAL != 0 {
+		return self.internalRemove(n, key, where)
+	} else if flags&lEAF != 0 {
+		return self.leafRemove(n, key, where)
+	} else {
+		return 0, 0, errors.Errorf("Unknown block type")
+	}
+}
+
+// internalRemove finds every child that could hold key (duplicate
+// keys can spill across more than one child) and recurses into each,
+// collapsing children that became empty and shrinking itself to its
+// single remaining child when only one is left.
+func (self *BpTree) internalRemove(n uint64, key []byte, where func(value []byte) bool) (newRoot uint64, removed int, err error) {
+	var lo, hi int
+	var ptrs []uint64
+	err = self.doInternal(n, func(n *internal) error {
+		lo, _ = find(int(n.meta.keyCount), n.keys, key)
+		if lo > 0 {
+			lo--
+		}
+		hi = lo
+		for hi < int(n.meta.keyCount)-1 && bytes.Compare(n.keys[hi+1], key) <= 0 {
+			hi++
+		}
+		ptrs = append(ptrs, n.ptrs[lo:hi+1]...)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	newPtrs := make(map[int]uint64, len(ptrs))
+	for i, ptr := range ptrs {
+		child, r, err := self.remove(ptr, key, where)
+		if err != nil {
+			return 0, 0, err
+		}
+		removed += r
+		newPtrs[lo+i] = child
+	}
+	err = self.doInternal(n, func(n *internal) error {
+		for i, child := range newPtrs {
+			n.ptrs[i] = child
+			err := self.firstKey(child, func(key []byte) error {
+				copy(n.keys[i], key)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	empty, err := self.emptyChildren(n)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range empty {
+		if err := self.internalDelKP(n, e); err != nil {
+			return 0, 0, err
+		}
+	}
+	var count int
+	var only uint64
+	err = self.doInternal(n, func(n *internal) error {
+		count = int(n.meta.keyCount)
+		if count == 1 {
+			only = n.ptrs[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 1 {
+		if err := self.freeInternal(n); err != nil {
+			return 0, 0, err
+		}
+		return only, removed, nil
+	}
+	return n, removed, nil
+}
+
+// emptyChildren returns the offsets of any direct children of n whose
+// key count has dropped to zero.
+func (self *BpTree) emptyChildren(n uint64) (empty []uint64, err error) {
+	err = self.doInternal(n, func(n *internal) error {
+		for i := 0; i < int(n.meta.keyCount); i++ {
+			ptr := n.ptrs[i]
+			var count int
+			var isLeaf bool
+			err := self.store.Do(ptr, 1, func(b []byte) error {
+				isLeaf = flag(b[0])&lEAF != 0
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if isLeaf {
+				err = self.doLeaf(ptr, func(l *leaf) error {
+					count = int(l.meta.keyCount)
+					return nil
+				})
+			} else {
+				err = self.doInternal(ptr, func(m *internal) error {
+					count = int(m.meta.keyCount)
+					return nil
+				})
+			}
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				empty = append(empty, ptr)
+			}
+		}
+		return nil
+	})
+	return empty, err
+}
+
+// internalDelKP removes the KP entry pointing at child from n and
+// frees child's block.
+func (self *BpTree) internalDelKP(n uint64, child uint64) error {
+	var isLeaf bool
+	err := self.store.Do(child, 1, func(b []byte) error {
+		isLeaf = flag(b[0])&lEAF != 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if isLeaf {
+		if err := self.removeListNode(child); err != nil {
+			return err
+		}
+	}
+	err = self.doInternal(n, func(n *internal) error {
+		return n.delKP(child)
+	})
+	if err != nil {
+		return err
+	}
+	return self.store.Free(child)
+}
+
+func (self *BpTree) freeInternal(n uint64) error {
+	return self.store.Free(n)
+}
+
+// removeListNode unlinks a leaf from the doubly linked leaf list
+// before it is freed, stitching its prev and next together the way
+// insertListNode stitches a new leaf in.
+func (self *BpTree) removeListNode(n uint64) error {
+	var prev, next uint64
+	err := self.doLeaf(n, func(n *leaf) error {
+		prev = n.meta.prev
+		next = n.meta.next
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if prev != 0 {
+		err = self.doLeaf(prev, func(n *leaf) error {
+			n.meta.next = next
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if next != 0 {
+		err = self.doLeaf(next, func(n *leaf) error {
+			n.meta.prev = prev
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafRemove deletes every entry in the leaf matching key and
+// satisfying where, freeing any big-value run each deleted entry
+// owned.
+func (self *BpTree) leafRemove(n uint64, key []byte, where func(value []byte) bool) (newRoot uint64, removed int, err error) {
+	var freed []uint64
+	err = self.doLeaf(n, func(n *leaf) error {
+		i, has := find(int(n.meta.keyCount), n.keys, key)
+		if !has || !bytes.Equal(n.keys[i], key) {
+			return nil
+		}
+		// keys with the same value are contiguous (the tree keeps
+		// them sorted), so find the bounds of this key's run and
+		// walk it back-to-front: that way deleting an index never
+		// shifts one we have yet to visit.
+		lo := i
+		for lo > 0 && bytes.Equal(n.keys[lo-1], key) {
+			lo--
+		}
+		hi := i
+		for hi+1 < int(n.meta.keyCount) && bytes.Equal(n.keys[hi+1], key) {
+			hi++
+		}
+		for idx := hi; idx >= lo; idx-- {
+			if !where(n.vals[idx]) {
+				continue
+			}
+			if n.flags[idx]&bIG_VALUE != 0 {
+				bv, err := parseBigValue(n.vals[idx])
+				if err != nil {
+					return err
+				}
+				freed = append(freed, bv.offset)
+			}
+			if err := n.delKV(idx); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, off := range freed {
+		if err := self.store.Free(off); err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, removed, nil
+}
@@ -0,0 +1,141 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRemoveDeletesKey(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("aaaa")
+	if err := tree.Add(key, []byte("v")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := tree.Remove(key); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, has, err := tree.getFirst(key); err != nil || has {
+		t.Fatalf("expected %s to be gone, has=%v err=%v", key, has, err)
+	}
+}
+
+func TestRemoveMissingKeyErrors(t *testing.T) {
+	tree := newTestTree(t, 4)
+	if err := tree.Remove([]byte("zzzz")); err == nil {
+		t.Fatalf("expected an error removing a key that was never added")
+	}
+}
+
+func TestRemoveWhereSkipsNonMatchingDuplicates(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("dupe")
+	// v1 will not satisfy where; v2 and v3 will. A predicate loop
+	// that bails out on the first non-matching duplicate would find
+	// v1, stop, and never remove v2/v3.
+	if err := tree.Add(key, []byte("v1")); err != nil {
+		t.Fatalf("Add v1: %v", err)
+	}
+	if err := tree.Add(key, []byte("v2")); err != nil {
+		t.Fatalf("Add v2: %v", err)
+	}
+	if err := tree.Add(key, []byte("v3")); err != nil {
+		t.Fatalf("Add v3: %v", err)
+	}
+	removed, err := tree.RemoveWhere(key, func(value []byte) bool {
+		return !bytes.Equal(value, []byte("v1"))
+	})
+	if err != nil {
+		t.Fatalf("RemoveWhere: %v", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 entries removed, got %d", removed)
+	}
+	remaining, err := tree.RemoveWhere(key, func(value []byte) bool { return true })
+	if err != nil {
+		t.Fatalf("RemoveWhere (cleanup): %v", err)
+	}
+	if remaining != 1 {
+		t.Fatalf("expected v1 to be the only entry left, found %d", remaining)
+	}
+}
+
+// TestRemoveCollapsesMultiLevelTree exercises the parts of Remove that
+// a single-leaf test never touches: internalRemove recursing across
+// several children (some of which hold duplicate keys spanning a leaf
+// boundary), emptyChildren/internalDelKP freeing children that drop
+// to zero entries, and the root-to-single-child collapse at the end
+// of internalRemove, all the way down to emptyRoot replacing the root
+// entirely once the last entry is gone.
+func TestRemoveCollapsesMultiLevelTree(t *testing.T) {
+	tree := newTestTree(t, 4)
+	originalRoot := tree.meta.root
+	const n = 400
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := tree.Add(key, []byte("v")); err != nil {
+			t.Fatalf("Add(%s): %v", key, err)
+		}
+	}
+	// duplicate a key that falls in the middle of the range so its
+	// run is likely to straddle a leaf boundary once the tree splits.
+	dupKey := []byte(fmt.Sprintf("%04d", n/2))
+	if err := tree.Add(dupKey, []byte("dup1")); err != nil {
+		t.Fatalf("Add dup1: %v", err)
+	}
+	if err := tree.Add(dupKey, []byte("dup2")); err != nil {
+		t.Fatalf("Add dup2: %v", err)
+	}
+	if tree.meta.root == originalRoot {
+		t.Fatalf("test setup did not actually grow the tree past a single leaf")
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if bytes.Equal(key, dupKey) {
+			continue
+		}
+		if err := tree.Remove(key); err != nil {
+			t.Fatalf("Remove(%s): %v", key, err)
+		}
+	}
+	removed, err := tree.RemoveWhere(dupKey, func(value []byte) bool { return true })
+	if err != nil {
+		t.Fatalf("RemoveWhere(%s): %v", dupKey, err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 entries removed for %s, got %d", dupKey, removed)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if _, has, err := tree.getFirst(key); err != nil || has {
+			t.Fatalf("getFirst(%s) after draining the tree: has=%v err=%v", key, has, err)
+		}
+	}
+	// the tree must be left with a single, valid, empty leaf as its
+	// root -- the same shape a freshly created tree starts in.
+	if err := tree.Add([]byte("zzzz"), []byte("alive")); err != nil {
+		t.Fatalf("Add after draining the tree: %v", err)
+	}
+	got, has, err := tree.getFirst([]byte("zzzz"))
+	if err != nil || !has {
+		t.Fatalf("getFirst(zzzz): has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(got, []byte("alive")) {
+		t.Fatalf("got %q, want %q", got, "alive")
+	}
+}
+
+func TestRemoveBigValue(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("big1")
+	big := bytes.Repeat([]byte("y"), int(tree.store.BlockSize()))
+	if err := tree.Add(key, big); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := tree.Remove(key); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, has, err := tree.getFirst(key); err != nil || has {
+		t.Fatalf("expected %s to be gone, has=%v err=%v", key, has, err)
+	}
+}
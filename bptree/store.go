@@ -0,0 +1,117 @@
+package bptree
+
+import (
+	"github.com/timtadh/fs2/fmap"
+)
+
+// NodeStore is the seam between BpTree's tree-shaped logic (insert,
+// put, remove, split, ...) and however its blocks are actually
+// stored. BpTree talks to self.store instead of reaching into
+// self.bf directly, the same split the SeaweedFS fork of this tree
+// found it needed. The default store is fmapStore, backed by the
+// same fmap.BlockFile the tree has always used; MemStore below is a
+// second implementation that keeps everything in memory, useful for
+// unit tests that want to exercise split/pure-run edge cases without
+// a temp file, and a template for other backends (encrypted,
+// networked, ...).
+type NodeStore interface {
+	// Alloc reserves n contiguous blocks and returns the offset of
+	// the first one.
+	Alloc(n int) (uint64, error)
+	// Do runs fn against the n blocks starting at off.
+	Do(off, n uint64, fn func([]byte) error) error
+	// Free returns the block(s) starting at off to the store.
+	Free(off uint64) error
+	// BlockSize is the fixed size, in bytes, of a single block.
+	BlockSize() uint64
+}
+
+// fmapStore is the NodeStore backed by a real fmap.BlockFile, i.e.
+// the storage BpTree has always used.
+type fmapStore struct {
+	bf *fmap.BlockFile
+}
+
+// NewFmapStore wraps bf as a NodeStore.
+func NewFmapStore(bf *fmap.BlockFile) NodeStore {
+	return &fmapStore{bf: bf}
+}
+
+func (self *fmapStore) Alloc(n int) (uint64, error) {
+	return self.bf.AllocateBlocks(n)
+}
+
+func (self *fmapStore) Do(off, n uint64, fn func([]byte) error) error {
+	return self.bf.Do(off, n, fn)
+}
+
+func (self *fmapStore) Free(off uint64) error {
+	return self.bf.Free(off)
+}
+
+func (self *fmapStore) BlockSize() uint64 {
+	return self.bf.BlockSize()
+}
+
+// MemStore is a pure in-memory NodeStore, useful for tests and for
+// any caller that wants a BpTree without a backing file. Blocks are
+// just byte slices in a map keyed by offset; offsets are handed out
+// sequentially starting at 1 (0 is reserved, the same as fmap's use
+// of 0 as a nil pointer).
+type MemStore struct {
+	blockSize uint64
+	next      uint64
+	blocks    map[uint64][]byte
+}
+
+// NewMemStore creates an empty MemStore whose blocks are blockSize
+// bytes each.
+func NewMemStore(blockSize uint64) *MemStore {
+	return &MemStore{
+		blockSize: blockSize,
+		next:      1,
+		blocks:    make(map[uint64][]byte),
+	}
+}
+
+func (self *MemStore) Alloc(n int) (uint64, error) {
+	off := self.next
+	self.next += uint64(n)
+	self.blocks[off] = make([]byte, uint64(n)*self.blockSize)
+	return off, nil
+}
+
+func (self *MemStore) Do(off, n uint64, fn func([]byte) error) error {
+	buf, has := self.blocks[off]
+	if !has {
+		buf = make([]byte, n*self.blockSize)
+		self.blocks[off] = buf
+	}
+	return fn(buf)
+}
+
+func (self *MemStore) Free(off uint64) error {
+	delete(self.blocks, off)
+	return nil
+}
+
+func (self *MemStore) BlockSize() uint64 {
+	return self.blockSize
+}
+
+// NewWithStore creates an empty BpTree, of the given key size, backed
+// by store. Paired with MemStore this is the constructor tests reach
+// for when they want to exercise the tree without a temp file.
+func NewWithStore(store NodeStore, keySize int) (*BpTree, error) {
+	tree := &BpTree{store: store}
+	tree.meta.keySize = uint32(keySize)
+	root, err := tree.newLeaf()
+	if err != nil {
+		return nil, err
+	}
+	tree.meta.root = root
+	if err := tree.writeMeta(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
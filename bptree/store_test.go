@@ -0,0 +1,66 @@
+package bptree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestTree builds a small BpTree backed by a MemStore, so tests
+// can exercise tree behavior without a temp file.
+func newTestTree(t *testing.T, keySize int) *BpTree {
+	t.Helper()
+	tree, err := NewWithStore(NewMemStore(4096), keySize)
+	if err != nil {
+		t.Fatalf("NewWithStore: %v", err)
+	}
+	return tree
+}
+
+func TestMemStoreAllocDoFree(t *testing.T) {
+	store := NewMemStore(128)
+	off, err := store.Alloc(1)
+	if err != nil {
+		t.Fatalf("Alloc: %v", err)
+	}
+	want := []byte("hello, block")
+	err = store.Do(off, 1, func(buf []byte) error {
+		copy(buf, want)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do (write): %v", err)
+	}
+	var got []byte
+	err = store.Do(off, 1, func(buf []byte) error {
+		got = make([]byte, len(want))
+		copy(got, buf[:len(want)])
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do (read): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if err := store.Free(off); err != nil {
+		t.Fatalf("Free: %v", err)
+	}
+}
+
+func TestNewWithStoreAddAndGet(t *testing.T) {
+	tree := newTestTree(t, 4)
+	key := []byte("key1")
+	if err := tree.Add(key, []byte("v1")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	value, has, err := tree.getFirst(key)
+	if err != nil {
+		t.Fatalf("getFirst: %v", err)
+	}
+	if !has {
+		t.Fatalf("expected key1 to be present")
+	}
+	if !bytes.Equal(value, []byte("v1")) {
+		t.Fatalf("got %q, want %q", value, "v1")
+	}
+}
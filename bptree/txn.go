@@ -0,0 +1,221 @@
+package bptree
+
+import (
+	"sort"
+)
+
+import (
+	"github.com/timtadh/fs2/errors"
+)
+
+// Txn batches a run of mutations (Add, Put, Remove, ...) against a
+// BpTree so their block writes and the final meta flush are
+// amortized into a single pass instead of going straight to the
+// underlying NodeStore on every call. It works by implementing
+// NodeStore itself: Add/Put/Upsert/Remove/RemoveWhere below swap the
+// tree's store for the txn for the duration of the call, so the
+// ordinary insert/put/remove algorithms run completely unmodified
+// and every block they touch -- including the meta block writeMeta
+// rewrites -- lands in the txn's dirty set instead of going to disk.
+// This is the same "dirty block buffer" pattern the file-structures
+// BTree.Insert example uses: touched blocks are flushed, in offset
+// order, only when the txn commits.
+//
+// Newly allocated blocks (e.g. from a split) are handed out
+// immediately through the underlying store rather than deferred;
+// only block writes (to new and existing blocks alike) and frees are
+// buffered. A rolled
+// back txn therefore does not reclaim blocks it allocated -- the
+// same tradeoff the dirty-block buffer it is modeled on makes.
+//
+// self.tree.meta.root is assigned directly by Add/Put/Remove rather
+// than written through the NodeStore, so it is not covered by the
+// dirty/freed maps above; Begin/Rollback snapshot and restore it
+// separately.
+type Txn struct {
+	tree      *BpTree
+	under     NodeStore
+	dirty     map[uint64][]byte
+	freed     map[uint64]bool
+	savedMeta meta
+	done      bool
+}
+
+var _ NodeStore = (*Txn)(nil)
+
+// Begin starts a Txn against the tree. While the Txn is open, run
+// mutations through its Add/Put/Upsert/Remove/RemoveWhere methods
+// (not the BpTree's directly) so that they get batched; Commit or
+// Rollback ends the txn.
+func (self *BpTree) Begin() *Txn {
+	return &Txn{
+		tree:      self,
+		under:     self.store,
+		dirty:     make(map[uint64][]byte),
+		freed:     make(map[uint64]bool),
+		savedMeta: self.meta,
+	}
+}
+
+// Alloc passes straight through to the underlying store -- new
+// blocks are allocated immediately; only block writes (including
+// writes to the newly allocated blocks) and frees are deferred until
+// Commit.
+func (self *Txn) Alloc(n int) (uint64, error) {
+	if self.done {
+		return 0, errors.Errorf("Txn is already committed or rolled back")
+	}
+	return self.under.Alloc(n)
+}
+
+// Do reads/writes n blocks starting at off, the same as the
+// underlying store's Do, except the write is buffered in the txn's
+// dirty set rather than going to disk immediately. Reads are
+// satisfied from the dirty set first so a txn sees its own
+// uncommitted writes.
+func (self *Txn) Do(off, n uint64, fn func([]byte) error) error {
+	if self.done {
+		return errors.Errorf("Txn is already committed or rolled back")
+	}
+	if buf, has := self.dirty[off]; has {
+		return fn(buf)
+	}
+	var buf []byte
+	err := self.under.Do(off, n, func(bytes []byte) error {
+		buf = make([]byte, len(bytes))
+		copy(buf, bytes)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := fn(buf); err != nil {
+		return err
+	}
+	self.dirty[off] = buf
+	return nil
+}
+
+// Free marks off as freed by this txn. The underlying block is not
+// actually returned to the freelist until Commit -- a Rollback
+// discards the request entirely, the same as it discards buffered
+// writes.
+func (self *Txn) Free(off uint64) error {
+	if self.done {
+		return errors.Errorf("Txn is already committed or rolled back")
+	}
+	self.freed[off] = true
+	delete(self.dirty, off)
+	return nil
+}
+
+// BlockSize passes straight through to the underlying store.
+func (self *Txn) BlockSize() uint64 {
+	return self.under.BlockSize()
+}
+
+// run swaps the tree's store for the txn, invokes fn (one of the
+// tree's ordinary mutation methods), and swaps the original store
+// back, so every block fn touches is captured in the txn's dirty set
+// instead of being written straight through.
+func (self *Txn) run(fn func() error) error {
+	if self.done {
+		return errors.Errorf("Txn is already committed or rolled back")
+	}
+	self.tree.store = self
+	defer func() { self.tree.store = self.under }()
+	return fn()
+}
+
+// Add stages an Add the same way BpTree.Add would, but against this
+// txn's dirty set.
+func (self *Txn) Add(key, value []byte) error {
+	return self.run(func() error {
+		return self.tree.Add(key, value)
+	})
+}
+
+// Put stages a Put.
+func (self *Txn) Put(key, value []byte) (replaced bool, err error) {
+	err = self.run(func() error {
+		var e error
+		replaced, e = self.tree.Put(key, value)
+		return e
+	})
+	return replaced, err
+}
+
+// Upsert stages an Upsert.
+func (self *Txn) Upsert(key []byte, fn func(old []byte, exists bool) (newVal []byte, keep bool)) error {
+	return self.run(func() error {
+		return self.tree.Upsert(key, fn)
+	})
+}
+
+// Remove stages a Remove.
+func (self *Txn) Remove(key []byte) error {
+	return self.run(func() error {
+		return self.tree.Remove(key)
+	})
+}
+
+// RemoveWhere stages a RemoveWhere.
+func (self *Txn) RemoveWhere(key []byte, where func(value []byte) bool) (removed int, err error) {
+	err = self.run(func() error {
+		var e error
+		removed, e = self.tree.RemoveWhere(key, where)
+		return e
+	})
+	return removed, err
+}
+
+// Commit flushes every dirty block to the underlying store in
+// offset order (so writes are sequential on disk), and frees every
+// block that was marked Free during the txn.
+func (self *Txn) Commit() error {
+	if self.done {
+		return errors.Errorf("Txn is already committed or rolled back")
+	}
+	self.done = true
+	offs := make([]uint64, 0, len(self.dirty))
+	for off := range self.dirty {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	for _, off := range offs {
+		buf := self.dirty[off]
+		n := uint64(blksNeeded(self.under.BlockSize(), len(buf)))
+		err := self.under.Do(off, n, func(bytes []byte) error {
+			copy(bytes, buf)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for off := range self.freed {
+		if err := self.under.Free(off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback discards every buffered write and pending free, and
+// restores self.tree.meta to what it was at Begin. The meta restore
+// matters because Add/Put/Remove assign self.meta.root directly on
+// the tree struct (not through the NodeStore), so without it a txn
+// that triggered a root change -- a split, an internal collapse, or
+// emptying the tree -- would leave meta.root pointing at a block that
+// was only ever written to the now-discarded dirty set. Nothing the
+// txn did is visible afterwards.
+func (self *Txn) Rollback() error {
+	if self.done {
+		return errors.Errorf("Txn is already committed or rolled back")
+	}
+	self.done = true
+	self.tree.meta = self.savedMeta
+	self.dirty = nil
+	self.freed = nil
+	return nil
+}
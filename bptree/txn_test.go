@@ -0,0 +1,146 @@
+package bptree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTxnCommitMakesWritesVisible(t *testing.T) {
+	tree := newTestTree(t, 4)
+	txn := tree.Begin()
+	if err := txn.Add([]byte("aaaa"), []byte("v1")); err != nil {
+		t.Fatalf("txn.Add: %v", err)
+	}
+	if err := txn.Add([]byte("bbbb"), []byte("v2")); err != nil {
+		t.Fatalf("txn.Add: %v", err)
+	}
+	// not visible against the tree directly until Commit.
+	if _, has, err := tree.getFirst([]byte("aaaa")); err != nil || has {
+		t.Fatalf("expected aaaa to be invisible before commit, has=%v err=%v", has, err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	for key, want := range map[string]string{"aaaa": "v1", "bbbb": "v2"} {
+		got, has, err := tree.getFirst([]byte(key))
+		if err != nil || !has {
+			t.Fatalf("getFirst(%s): has=%v err=%v", key, has, err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestTxnRollbackDiscardsWrites(t *testing.T) {
+	tree := newTestTree(t, 4)
+	txn := tree.Begin()
+	if err := txn.Add([]byte("cccc"), []byte("v")); err != nil {
+		t.Fatalf("txn.Add: %v", err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if _, has, err := tree.getFirst([]byte("cccc")); err != nil || has {
+		t.Fatalf("expected cccc to be absent after rollback, has=%v err=%v", has, err)
+	}
+}
+
+// TestTxnRollbackAfterSplitRestoresMeta guards against a txn whose
+// mutations trigger a root change (here, enough Adds to split the
+// initial leaf and promote a fresh internal node to root) leaving
+// tree.meta.root pointing at a block that only ever existed in the
+// now-discarded dirty set once Rollback runs.
+func TestTxnRollbackAfterSplitRestoresMeta(t *testing.T) {
+	tree := newTestTree(t, 4)
+	originalRoot := tree.meta.root
+	txn := tree.Begin()
+	const n = 500
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if err := txn.Add(key, []byte("v")); err != nil {
+			t.Fatalf("txn.Add(%s): %v", key, err)
+		}
+	}
+	if tree.meta.root == originalRoot {
+		t.Fatalf("test setup did not actually trigger a root change inside the txn")
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if tree.meta.root != originalRoot {
+		t.Fatalf("meta.root was not restored by Rollback: got %d, want %d", tree.meta.root, originalRoot)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("%04d", i))
+		if _, has, err := tree.getFirst(key); err != nil || has {
+			t.Fatalf("getFirst(%s) after rollback: has=%v err=%v", key, has, err)
+		}
+	}
+	// the tree must still be fully usable after rollback -- if meta
+	// hadn't been restored, this would read through a stale/garbage
+	// root pointer.
+	if err := tree.Add([]byte("zzzz"), []byte("alive")); err != nil {
+		t.Fatalf("Add after rollback: %v", err)
+	}
+	got, has, err := tree.getFirst([]byte("zzzz"))
+	if err != nil || !has {
+		t.Fatalf("getFirst(zzzz): has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(got, []byte("alive")) {
+		t.Fatalf("got %q, want %q", got, "alive")
+	}
+}
+
+func TestTxnUseAfterCommitErrors(t *testing.T) {
+	tree := newTestTree(t, 4)
+	txn := tree.Begin()
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := txn.Add([]byte("dddd"), []byte("v")); err == nil {
+		t.Fatalf("expected an error adding through an already-committed txn")
+	}
+}
+
+func TestTxnRemove(t *testing.T) {
+	tree := newTestTree(t, 4)
+	if err := tree.Add([]byte("eeee"), []byte("v")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	txn := tree.Begin()
+	if err := txn.Remove([]byte("eeee")); err != nil {
+		t.Fatalf("txn.Remove: %v", err)
+	}
+	if _, has, err := tree.getFirst([]byte("eeee")); err != nil || !has {
+		t.Fatalf("expected eeee to still be visible before commit, has=%v err=%v", has, err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if _, has, err := tree.getFirst([]byte("eeee")); err != nil || has {
+		t.Fatalf("expected eeee to be gone after commit, has=%v err=%v", has, err)
+	}
+}
+
+func TestTxnPut(t *testing.T) {
+	tree := newTestTree(t, 4)
+	if err := tree.Add([]byte("ffff"), []byte("old")); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	txn := tree.Begin()
+	if _, err := txn.Put([]byte("ffff"), []byte("new")); err != nil {
+		t.Fatalf("txn.Put: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	got, has, err := tree.getFirst([]byte("ffff"))
+	if err != nil || !has {
+		t.Fatalf("getFirst: has=%v err=%v", has, err)
+	}
+	if !bytes.Equal(got, []byte("new")) {
+		t.Fatalf("got %q, want %q", got, "new")
+	}
+}